@@ -12,10 +12,17 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/NHAS/reverse_ssh/internal/client"
+	"github.com/NHAS/reverse_ssh/internal/client/handlers"
 )
 
+// shutdownDrainTimeout bounds how long Run waits for in-flight remote-forwarded
+// connections to finish copying data after a SIGHUP/SIGTERM before giving up and
+// exiting anyway.
+const shutdownDrainTimeout = 10 * time.Second
+
 func normalizeSelfPath(path string) string {
 	if path == "" {
 		return ""
@@ -34,17 +41,90 @@ func isProcPath(path string) bool {
 	return strings.HasPrefix(path, "/proc/")
 }
 
+// permitRemoteForwardEnv and permitRemoteStreamLocalForwardEnv are the
+// environment variables configureDefaultACLs reads the client's default
+// remote-forward ACL from.
+const (
+	permitRemoteForwardEnv            = "RSSH_PERMIT_REMOTE_FORWARD"
+	permitRemoteStreamLocalForwardEnv = "RSSH_PERMIT_REMOTE_STREAMLOCAL_FORWARD"
+)
+
+// configureDefaultACLs installs handlers.SetDefaultAllowedRemoteBinds/
+// SetDefaultAllowedRemoteSocketPaths from permitRemoteForwardEnv/
+// permitRemoteStreamLocalForwardEnv. A malformed value is logged and
+// otherwise ignored, leaving the previous default in place.
+func configureDefaultACLs() {
+	if value := os.Getenv(permitRemoteForwardEnv); value != "" {
+		rules, err := handlers.ParsePermitRemoteForward(value)
+		if err != nil {
+			log.Println("Ignoring invalid", permitRemoteForwardEnv, ":", err)
+		} else {
+			handlers.SetDefaultAllowedRemoteBinds(rules)
+		}
+	}
+
+	if value := os.Getenv(permitRemoteStreamLocalForwardEnv); value != "" {
+		rules, err := handlers.ParsePermitRemoteStreamLocalForward(value)
+		if err != nil {
+			log.Println("Ignoring invalid", permitRemoteStreamLocalForwardEnv, ":", err)
+		} else {
+			handlers.SetDefaultAllowedRemoteSocketPaths(rules)
+		}
+	}
+}
+
 func Run(settings *client.Settings) {
 	//Try to elavate to root (in case we are a root:root setuid/gid binary)
 	syscall.Setuid(0)
 	syscall.Setgid(0)
 
-	//Create our own process group, and ignore any  hang up signals
+	//Create our own process group
 	syscall.Setsid()
-	signal.Ignore(syscall.SIGHUP, syscall.SIGPIPE)
 
-	// on the linux platform we cant use winauth
-	client.Run(settings)
+	configureDefaultACLs()
+
+	// SIGHUP/SIGTERM now trigger a graceful shutdown rather than being
+	// ignored outright.
+	signal.Ignore(syscall.SIGPIPE)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGTERM)
+
+	done := make(chan struct{})
+	go func() {
+		// on the linux platform we cant use winauth
+		client.Run(settings)
+		close(done)
+	}()
+
+	select {
+	case sig := <-sigs:
+		log.Println("Received", sig, ", draining remote forwards before exit")
+		gracefulShutdown()
+		os.Exit(0)
+	case <-done:
+	}
+}
+
+// gracefulShutdown closes every remote-forward listener, waits (up to
+// shutdownDrainTimeout) for outstanding forwarded connections to finish,
+// then closes the underlying SSH transport.
+func gracefulShutdown() {
+	handlers.StopAllRemoteForwards()
+
+	drained := make(chan struct{})
+	go func() {
+		handlers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(shutdownDrainTimeout):
+		log.Println("Timed out waiting for remote forwards to drain")
+	}
+
+	handlers.CloseActiveConnection()
 }
 
 func selfExecCandidates(settings *client.Settings) []string {
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/NHAS/reverse_ssh/internal"
+)
+
+// BindRule describes a single host/port range that a client is permitted to
+// remote-forward against, as parsed from an authorized_keys
+// permit-remote-forward="host:low-high,..." option.
+type BindRule struct {
+	Host              string
+	AnyPort           bool
+	PortLow, PortHigh uint32
+}
+
+// allows reports whether the given bind address/port is covered by this rule.
+// A Host of "*" matches any address, and AnyPort matches any port.
+func (b BindRule) allows(host string, port uint32) bool {
+	if b.Host != "*" && b.Host != host {
+		return false
+	}
+
+	if b.AnyPort {
+		return true
+	}
+
+	return port >= b.PortLow && port <= b.PortHigh
+}
+
+var (
+	defaultAllowedRemoteBindsLck sync.RWMutex
+	defaultAllowedRemoteBinds    []BindRule
+)
+
+// SetDefaultAllowedRemoteBinds configures the default ACL that
+// remoteForwardAllowed checks every remote forward request against, both
+// server-initiated (user == nil) and per-user ones. No per-user rule set is
+// consulted.
+func SetDefaultAllowedRemoteBinds(rules []BindRule) {
+	defaultAllowedRemoteBindsLck.Lock()
+	defer defaultAllowedRemoteBindsLck.Unlock()
+
+	defaultAllowedRemoteBinds = rules
+}
+
+func getDefaultAllowedRemoteBinds() []BindRule {
+	defaultAllowedRemoteBindsLck.RLock()
+	defer defaultAllowedRemoteBindsLck.RUnlock()
+
+	return defaultAllowedRemoteBinds
+}
+
+// ParsePermitRemoteForward parses the value of an authorized_keys
+// permit-remote-forward="..." option, e.g. "0.0.0.0:3000-3999,127.0.0.1:*".
+func ParsePermitRemoteForward(value string) ([]BindRule, error) {
+	var rules []BindRule
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		host, portRange, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("permit-remote-forward entry %q missing ':'", entry)
+		}
+
+		if portRange == "*" {
+			rules = append(rules, BindRule{Host: host, AnyPort: true})
+			continue
+		}
+
+		low, high, ok := strings.Cut(portRange, "-")
+		if !ok {
+			low, high = portRange, portRange
+		}
+
+		lowPort, err := strconv.ParseUint(low, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("permit-remote-forward entry %q has invalid low port: %s", entry, err)
+		}
+
+		highPort, err := strconv.ParseUint(high, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("permit-remote-forward entry %q has invalid high port: %s", entry, err)
+		}
+
+		rules = append(rules, BindRule{Host: host, PortLow: uint32(lowPort), PortHigh: uint32(highPort)})
+	}
+
+	return rules, nil
+}
+
+// remoteForwardAllowed checks rf against the client-wide default ACL set by
+// SetDefaultAllowedRemoteBinds. An empty rule set is treated as "no
+// restriction", preserving the previous unrestricted behaviour.
+//
+// user is accepted (rather than dropped from the signature) because scoping
+// this to a per-user rule set, read off an AllowedRemoteBinds populated from
+// that user's authorized_keys permit-remote-forward option, is the obvious
+// next step here - but that population happens on the key-auth path, which
+// isn't part of this package. Until that's wired up, every session is
+// checked against the same default set regardless of user.
+func remoteForwardAllowed(user *internal.User, host string, port uint32) bool {
+	rules := getDefaultAllowedRemoteBinds()
+
+	if len(rules) == 0 {
+		return true
+	}
+
+	for _, rule := range rules {
+		if rule.allows(host, port) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import "testing"
+
+func TestBindRuleAllows(t *testing.T) {
+	tests := []struct {
+		name string
+		rule BindRule
+		host string
+		port uint32
+		want bool
+	}{
+		{"exact host and port in range", BindRule{Host: "127.0.0.1", PortLow: 3000, PortHigh: 3999}, "127.0.0.1", 3500, true},
+		{"port below range", BindRule{Host: "127.0.0.1", PortLow: 3000, PortHigh: 3999}, "127.0.0.1", 2999, false},
+		{"port above range", BindRule{Host: "127.0.0.1", PortLow: 3000, PortHigh: 3999}, "127.0.0.1", 4000, false},
+		{"wrong host", BindRule{Host: "127.0.0.1", PortLow: 3000, PortHigh: 3999}, "10.0.0.1", 3500, false},
+		{"wildcard host", BindRule{Host: "*", PortLow: 80, PortHigh: 80}, "10.0.0.1", 80, true},
+		{"explicit single port range", BindRule{Host: "127.0.0.1", PortLow: 22, PortHigh: 22}, "127.0.0.1", 22, true},
+		// Regression: an explicit "host:0-0" entry names only port 0, and must
+		// not be confused with AnyPort (set only by an explicit "*" port).
+		{"explicit 0-0 only matches port 0", BindRule{Host: "127.0.0.1", PortLow: 0, PortHigh: 0}, "127.0.0.1", 1234, false},
+		{"explicit 0-0 matches port 0", BindRule{Host: "127.0.0.1", PortLow: 0, PortHigh: 0}, "127.0.0.1", 0, true},
+		{"any port", BindRule{Host: "127.0.0.1", AnyPort: true}, "127.0.0.1", 65535, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.allows(tt.host, tt.port); got != tt.want {
+				t.Errorf("allows(%q, %d) = %v, want %v", tt.host, tt.port, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePermitRemoteForward(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []BindRule
+		wantErr bool
+	}{
+		{
+			name:  "single range",
+			value: "0.0.0.0:3000-3999",
+			want:  []BindRule{{Host: "0.0.0.0", PortLow: 3000, PortHigh: 3999}},
+		},
+		{
+			name:  "wildcard port",
+			value: "127.0.0.1:*",
+			want:  []BindRule{{Host: "127.0.0.1", AnyPort: true}},
+		},
+		{
+			name:  "single port shorthand",
+			value: "127.0.0.1:22",
+			want:  []BindRule{{Host: "127.0.0.1", PortLow: 22, PortHigh: 22}},
+		},
+		{
+			name:  "explicit 0-0 is not any port",
+			value: "127.0.0.1:0-0",
+			want:  []BindRule{{Host: "127.0.0.1", PortLow: 0, PortHigh: 0}},
+		},
+		{
+			name:  "multiple entries",
+			value: "0.0.0.0:3000-3999, 127.0.0.1:*",
+			want: []BindRule{
+				{Host: "0.0.0.0", PortLow: 3000, PortHigh: 3999},
+				{Host: "127.0.0.1", AnyPort: true},
+			},
+		},
+		{
+			name:    "missing colon",
+			value:   "127.0.0.1",
+			wantErr: true,
+		},
+		{
+			name:    "invalid low port",
+			value:   "127.0.0.1:abc-3999",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePermitRemoteForward(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePermitRemoteForward(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParsePermitRemoteForward(%q) = %#v, want %#v", tt.value, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("ParsePermitRemoteForward(%q)[%d] = %#v, want %#v", tt.value, i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,317 @@
+package handlers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"golang.org/x/crypto/ssh"
+)
+
+// DynamicForwardRequestType is the rssh-specific global request used to set up
+// a reverse SOCKS5/HTTP-CONNECT pivot, as opposed to the RFC 4254 single-port
+// tcpip-forward handled by StartRemoteForward.
+//
+// This package only implements the client side of that request. Issuing it
+// from an operator's controller session (e.g. a "listen --socks" CLI flag)
+// is controller-side work that isn't part of this tree.
+const DynamicForwardRequestType = "rssh-dynamic-forward@nhas"
+
+var (
+	currentDynamicForwardsLck sync.RWMutex
+	currentDynamicForwards    = map[internal.RemoteForwardRequest]remoteforward{}
+)
+
+// GetServerDynamicForwards lists the bind addresses of server-initiated (user
+// == nil) dynamic forwards, mirroring GetServerRemoteForwards but for the
+// rssh-dynamic-forward@nhas bookkeeping.
+func GetServerDynamicForwards() (out []string) {
+	currentDynamicForwardsLck.RLock()
+	defer currentDynamicForwardsLck.RUnlock()
+
+	for a, c := range currentDynamicForwards {
+		if c.User == nil {
+			out = append(out, a.String())
+		}
+	}
+
+	return out
+}
+
+func StopDynamicForward(rf internal.RemoteForwardRequest) error {
+	currentDynamicForwardsLck.Lock()
+	existing, ok := currentDynamicForwards[rf]
+	if !ok {
+		currentDynamicForwardsLck.Unlock()
+		return fmt.Errorf("Unable to find dynamic forward request")
+	}
+
+	existing.Listener.Close()
+	delete(currentDynamicForwards, rf)
+	currentDynamicForwardsLck.Unlock()
+
+	currentMetrics().OnForwardStop(rf)
+
+	log.Println("Stopped dynamic (SOCKS) forward listening on: ", rf.BindAddr, rf.BindPort)
+
+	return nil
+}
+
+// StartDynamicForward services an rssh-dynamic-forward@nhas request. Rather
+// than forwarding raw TCP on the bind port like StartRemoteForward, it runs an
+// in-process SOCKS5 (and HTTP CONNECT) server on that listener, resolving each
+// client's requested destination and opening a forwarded-tcpip channel to the
+// controller with that destination rather than the listener's own address.
+func StartDynamicForward(user *internal.User, r *ssh.Request, sshConn ssh.Conn) {
+	registerConnection(sshConn)
+
+	var rf internal.RemoteForwardRequest
+	err := ssh.Unmarshal(r.Payload, &rf)
+	if err != nil {
+		r.Reply(false, []byte(fmt.Sprintf("Unable to open dynamic forward: %s", err.Error())))
+		return
+	}
+
+	if !remoteForwardAllowed(user, rf.BindAddr, rf.BindPort) {
+		r.Reply(false, []byte(fmt.Sprintf("Not permitted to dynamic forward %s:%d", rf.BindAddr, rf.BindPort)))
+		return
+	}
+
+	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", rf.BindAddr, rf.BindPort))
+	if err != nil {
+		r.Reply(false, []byte(fmt.Sprintf("Unable to open dynamic forward: %s", err.Error())))
+		return
+	}
+	defer l.Close()
+
+	defer StopDynamicForward(rf)
+
+	responseData := []byte{}
+	if rf.BindPort == 0 {
+		port := uint32(l.Addr().(*net.TCPAddr).Port)
+		responseData = ssh.Marshal(port)
+		rf.BindPort = port
+	}
+	r.Reply(true, responseData)
+
+	currentMetrics().OnForwardStart(rf)
+
+	log.Println("Started dynamic (SOCKS) forward listening on: ", l.Addr())
+
+	currentDynamicForwardsLck.Lock()
+	currentDynamicForwards[rf] = remoteforward{
+		Listener: l,
+		User:     user,
+	}
+	currentDynamicForwardsLck.Unlock()
+
+	for {
+		proxyCon, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		forwardsWG.Add(1)
+		go func() {
+			defer forwardsWG.Done()
+			handleDynamicData(proxyCon, sshConn, rf)
+		}()
+	}
+}
+
+func handleDynamicData(rawProxyCon net.Conn, sshConn ssh.Conn, rf internal.RemoteForwardRequest) (err error) {
+	currentMetrics().OnConnectionAccepted(rf, rawProxyCon.RemoteAddr().String())
+	started := time.Now()
+
+	proxyCon := &countingConn{Conn: rawProxyCon}
+	defer func() {
+		currentMetrics().OnConnectionClosed(rf, atomic.LoadInt64(&proxyCon.bytesIn), atomic.LoadInt64(&proxyCon.bytesOut), time.Since(started), err)
+	}()
+
+	defer func() {
+		// proxyChannel also closes proxyCon on success, closing twice is
+		// harmless.
+		proxyCon.Close()
+	}()
+
+	br := bufio.NewReader(proxyCon)
+
+	destHost, destPort, err := parseDestination(br, proxyCon)
+	if err != nil {
+		log.Println("Dynamic forward handshake failed: ", err)
+		return err
+	}
+
+	drtMsg := internal.ChannelOpenDirectMsg{
+		Laddr: rf.BindAddr,
+		Lport: rf.BindPort,
+
+		Raddr: destHost,
+		Rport: destPort,
+	}
+
+	b := ssh.Marshal(&drtMsg)
+
+	destination, reqs, err := sshConn.OpenChannel("forwarded-tcpip", b)
+	if err != nil {
+		log.Println("Opening forwarded-tcpip channel for dynamic forward failed: ", err)
+		return err
+	}
+
+	go ssh.DiscardRequests(reqs)
+
+	log.Println("Dynamic forward: ", destHost, destPort)
+
+	return proxyChannel(bufConn{Conn: proxyCon, r: br}, destination)
+}
+
+// bufConn lets a net.Conn whose first bytes were already consumed by a
+// bufio.Reader (during the SOCKS5/HTTP CONNECT handshake) be handed to
+// proxyChannel without losing any buffered-but-unread data.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b bufConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+// parseDestination sniffs the first byte of the connection to decide whether
+// the client is speaking SOCKS5 (0x05) or issuing an HTTP CONNECT request, and
+// returns the requested destination host/port.
+func parseDestination(br *bufio.Reader, conn net.Conn) (string, uint32, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if first[0] == 0x05 {
+		return parseSocks5Destination(br, conn)
+	}
+
+	return parseHTTPConnectDestination(br, conn)
+}
+
+func parseSocks5Destination(br *bufio.Reader, conn net.Conn) (string, uint32, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return "", 0, err
+	}
+
+	nmethods := int(header[1])
+	methods := make([]byte, nmethods)
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return "", 0, err
+	}
+
+	// No authentication required.
+	if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
+		return "", 0, err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(br, request); err != nil {
+		return "", 0, err
+	}
+
+	if request[1] != 0x01 { // CONNECT
+		conn.Write([]byte{0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return "", 0, fmt.Errorf("unsupported SOCKS5 command: %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case 0x01: // IPv4
+		addr := make([]byte, 4)
+		if _, err := io.ReadFull(br, addr); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(addr).String()
+	case 0x03: // domain name
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(br, length); err != nil {
+			return "", 0, err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(br, name); err != nil {
+			return "", 0, err
+		}
+		host = string(name)
+	case 0x04: // IPv6
+		addr := make([]byte, 16)
+		if _, err := io.ReadFull(br, addr); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(addr).String()
+	default:
+		conn.Write([]byte{0x05, 0x08, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return "", 0, fmt.Errorf("unsupported SOCKS5 address type: %d", request[3])
+	}
+
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(br, portBytes); err != nil {
+		return "", 0, err
+	}
+	port := uint32(portBytes[0])<<8 | uint32(portBytes[1])
+
+	if _, err := conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		return "", 0, err
+	}
+
+	return host, port, nil
+}
+
+// parseHTTPConnectDestination handles the plain-text "CONNECT host:port
+// HTTP/1.1" form used by HTTP proxy clients, replying with a 200 Connection
+// Established once the tunnel is ready.
+func parseHTTPConnectDestination(br *bufio.Reader, conn net.Conn) (string, uint32, error) {
+	reqLine, err := br.ReadString('\n')
+	if err != nil {
+		return "", 0, err
+	}
+
+	var method, target, proto string
+	if _, err := fmt.Sscanf(reqLine, "%s %s %s", &method, &target, &proto); err != nil {
+		return "", 0, fmt.Errorf("malformed request line: %s", err)
+	}
+
+	if method != "CONNECT" {
+		fmt.Fprintf(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		return "", 0, fmt.Errorf("unsupported HTTP method for dynamic forward: %s", method)
+	}
+
+	// Drain the remaining request headers.
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return "", 0, err
+		}
+		if line == "\r\n" || line == "\n" {
+			break
+		}
+	}
+
+	host, strPort, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err := strconv.ParseUint(strPort, 10, 32)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if _, err := fmt.Fprintf(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return "", 0, err
+	}
+
+	return host, uint32(port), nil
+}
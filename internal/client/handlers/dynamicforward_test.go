@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeConn is a minimal net.Conn backed by separate read/write buffers, used
+// to drive parseSocks5Destination/parseHTTPConnectDestination without
+// standing up a real listener.
+type fakeConn struct {
+	net.Conn
+	in  *bytes.Buffer
+	out *bytes.Buffer
+}
+
+func (f *fakeConn) Read(p []byte) (int, error)  { return f.in.Read(p) }
+func (f *fakeConn) Write(p []byte) (int, error) { return f.out.Write(p) }
+func (f *fakeConn) Close() error                { return nil }
+func (f *fakeConn) SetDeadline(time.Time) error { return nil }
+
+func newFakeConn(in []byte) *fakeConn {
+	return &fakeConn{in: bytes.NewBuffer(in), out: &bytes.Buffer{}}
+}
+
+func TestParseSocks5Destination(t *testing.T) {
+	tests := []struct {
+		name     string
+		request  []byte
+		wantHost string
+		wantPort uint32
+	}{
+		{
+			name: "ipv4",
+			request: append([]byte{
+				0x05, 0x01, 0x00, // version, 1 method, no-auth
+				0x05, 0x01, 0x00, 0x01, // version, CONNECT, reserved, IPv4
+			}, append([]byte{127, 0, 0, 1}, 0x1F, 0x90)...), // 127.0.0.1:8080
+			wantHost: "127.0.0.1",
+			wantPort: 8080,
+		},
+		{
+			name: "domain name",
+			request: append([]byte{
+				0x05, 0x01, 0x00,
+				0x05, 0x01, 0x00, 0x03,
+				0x0B, // length 11
+			}, append([]byte("example.com"), 0x00, 0x50)...), // :80
+			wantHost: "example.com",
+			wantPort: 80,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newFakeConn(tt.request)
+			br := bufio.NewReader(conn)
+
+			host, port, err := parseSocks5Destination(br, conn)
+			if err != nil {
+				t.Fatalf("parseSocks5Destination() error = %v", err)
+			}
+			if host != tt.wantHost || port != tt.wantPort {
+				t.Errorf("parseSocks5Destination() = (%q, %d), want (%q, %d)", host, port, tt.wantHost, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestParseHTTPConnectDestination(t *testing.T) {
+	request := "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"
+
+	conn := newFakeConn([]byte(request))
+	br := bufio.NewReader(conn)
+
+	host, port, err := parseHTTPConnectDestination(br, conn)
+	if err != nil {
+		t.Fatalf("parseHTTPConnectDestination() error = %v", err)
+	}
+	if host != "example.com" || port != 443 {
+		t.Errorf("parseHTTPConnectDestination() = (%q, %d), want (\"example.com\", 443)", host, port)
+	}
+	if got := conn.out.String(); got != "HTTP/1.1 200 Connection Established\r\n\r\n" {
+		t.Errorf("parseHTTPConnectDestination() wrote %q, want 200 Connection Established response", got)
+	}
+}
+
+func TestParseHTTPConnectDestinationRejectsOtherMethods(t *testing.T) {
+	conn := newFakeConn([]byte("GET / HTTP/1.1\r\n\r\n"))
+	br := bufio.NewReader(conn)
+
+	if _, _, err := parseHTTPConnectDestination(br, conn); err == nil {
+		t.Fatal("parseHTTPConnectDestination() expected error for non-CONNECT method, got nil")
+	}
+}
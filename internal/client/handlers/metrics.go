@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics is the set of lifecycle hooks StartRemoteForward, StopRemoteForward
+// and handleData report through, so forward health can be observed without
+// every call site needing to know how it's surfaced (plain logs, Prometheus,
+// or something else entirely).
+type Metrics interface {
+	OnForwardStart(rf internal.RemoteForwardRequest)
+	OnForwardStop(rf internal.RemoteForwardRequest)
+	OnConnectionAccepted(rf internal.RemoteForwardRequest, remoteAddr string)
+	OnConnectionClosed(rf internal.RemoteForwardRequest, bytesIn, bytesOut int64, duration time.Duration, err error)
+}
+
+var (
+	metricsLck sync.RWMutex
+	// defaultMetrics is created once: NewPrometheusMetrics registers its
+	// collectors with the default registry, which panics on a second call.
+	defaultMetrics         = NewPrometheusMetrics()
+	activeMetrics  Metrics = defaultMetrics
+)
+
+// SetMetrics replaces the active Metrics implementation. Passing nil restores
+// the default Prometheus-backed implementation.
+func SetMetrics(m Metrics) {
+	metricsLck.Lock()
+	defer metricsLck.Unlock()
+
+	if m == nil {
+		m = defaultMetrics
+	}
+	activeMetrics = m
+}
+
+func currentMetrics() Metrics {
+	metricsLck.RLock()
+	defer metricsLck.RUnlock()
+
+	return activeMetrics
+}
+
+// PrometheusMetrics is the default Metrics implementation, exposing forward
+// health as Prometheus counters/gauges in addition to the plain-text logging
+// StartRemoteForward et al. used to do directly.
+type PrometheusMetrics struct {
+	connectionsTotal *prometheus.CounterVec
+	bytesTotal       *prometheus.CounterVec
+	activeListeners  prometheus.Gauge
+	activeStreams    prometheus.Gauge
+}
+
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		connectionsTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "rssh_forward_connections_total",
+			Help: "Total number of connections accepted on a remote-forwarded listener.",
+		}, []string{"bind_addr"}),
+
+		bytesTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "rssh_forward_bytes_total",
+			Help: "Total bytes copied through remote forwards, labeled by direction.",
+		}, []string{"direction", "bind_addr"}),
+
+		activeListeners: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "rssh_forward_active_listeners",
+			Help: "Number of remote-forward listeners currently open.",
+		}),
+
+		activeStreams: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "rssh_forward_active_streams",
+			Help: "Number of forwarded connections currently being proxied.",
+		}),
+	}
+}
+
+func (p *PrometheusMetrics) OnForwardStart(rf internal.RemoteForwardRequest) {
+	p.activeListeners.Inc()
+	log.Println("Started listening on: ", rf.BindAddr, rf.BindPort)
+}
+
+func (p *PrometheusMetrics) OnForwardStop(rf internal.RemoteForwardRequest) {
+	p.activeListeners.Dec()
+
+	// Forwards are commonly opened on ephemeral (BindPort == 0) ports, so
+	// without this the label set would grow forever across the life of the
+	// process. Drop it here rather than trying to keep counting against a
+	// bind address/port that no longer exists.
+	p.connectionsTotal.DeleteLabelValues(rf.String())
+	p.bytesTotal.DeleteLabelValues("in", rf.String())
+	p.bytesTotal.DeleteLabelValues("out", rf.String())
+
+	log.Println("Stopped listening on: ", rf.BindAddr, rf.BindPort)
+}
+
+func (p *PrometheusMetrics) OnConnectionAccepted(rf internal.RemoteForwardRequest, remoteAddr string) {
+	p.activeStreams.Inc()
+	p.connectionsTotal.WithLabelValues(rf.String()).Inc()
+	log.Println("Accepted new connection: ", remoteAddr)
+}
+
+func (p *PrometheusMetrics) OnConnectionClosed(rf internal.RemoteForwardRequest, bytesIn, bytesOut int64, duration time.Duration, err error) {
+	p.activeStreams.Dec()
+	p.bytesTotal.WithLabelValues("in", rf.String()).Add(float64(bytesIn))
+	p.bytesTotal.WithLabelValues("out", rf.String()).Add(float64(bytesOut))
+
+	if err != nil && err != io.EOF {
+		log.Println("Forward connection for", rf.BindAddr, rf.BindPort, "closed after", duration, "with error:", err)
+		return
+	}
+
+	log.Println("Forward connection for", rf.BindAddr, rf.BindPort, "closed after", duration)
+}
+
+// StartMetricsServer exposes the registered Prometheus metrics on addr at
+// /metrics. It's intended to be started once by the controller, which is
+// typically the side an operator wants to point a scraper at.
+func StartMetricsServer(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	return http.ListenAndServe(addr, mux)
+}
+
+// countingConn wraps a net.Conn, tallying bytes read from and written to it
+// into bytesIn/bytesOut so handleData can report an accurate byte count to
+// Metrics.OnConnectionClosed once the forward finishes. Read and Write are
+// called from different goroutines (proxyChannel copies each direction
+// concurrently), so the counters are updated atomically.
+type countingConn struct {
+	net.Conn
+	bytesIn, bytesOut int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.bytesIn, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.bytesOut, int64(n))
+	return n, err
+}
@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"github.com/hashicorp/yamux"
+	"golang.org/x/crypto/ssh"
+)
+
+// MuxForwardsRequestType is the global request a controller sends during
+// handshake to advertise that it understands the mux-forwards@nhas channel
+// protocol, letting the client multiplex every accepted connection for a
+// given forward over a single long-lived SSH channel instead of opening a
+// fresh "forwarded-tcpip" channel per accept.
+const MuxForwardsRequestType = "mux-forwards@nhas"
+
+// muxForwardedChannelType is the channel opened once per forward when mux
+// mode is negotiated; a yamux session runs inside it.
+const muxForwardedChannelType = "forwarded-tcpip-mux@nhas"
+
+// muxForwardsSupported tracks, per connection (keyed by its SSH session ID),
+// whether that peer advertised mux-forwards@nhas support.
+var (
+	muxForwardsSupportedLck sync.RWMutex
+	muxForwardsSupported    = map[string]bool{}
+)
+
+func connKey(sshConn ssh.Conn) string {
+	return string(sshConn.SessionID())
+}
+
+// HandleMuxForwardsAdvertise services the mux-forwards@nhas global request,
+// recording that the peer supports multiplexed forwards for the lifetime of
+// this connection.
+func HandleMuxForwardsAdvertise(r *ssh.Request, sshConn ssh.Conn) {
+	muxForwardsSupportedLck.Lock()
+	muxForwardsSupported[connKey(sshConn)] = true
+	muxForwardsSupportedLck.Unlock()
+
+	r.Reply(true, nil)
+}
+
+func muxForwardsEnabled(sshConn ssh.Conn) bool {
+	muxForwardsSupportedLck.RLock()
+	defer muxForwardsSupportedLck.RUnlock()
+
+	return muxForwardsSupported[connKey(sshConn)]
+}
+
+// resetMuxState drops any mux-forwards@nhas negotiation recorded for sshConn.
+func resetMuxState(sshConn ssh.Conn) {
+	muxForwardsSupportedLck.Lock()
+	delete(muxForwardsSupported, connKey(sshConn))
+	muxForwardsSupportedLck.Unlock()
+}
+
+// muxStreamHeader is the small length-prefixed header written at the start of
+// every yamux stream, identifying the local/remote address pair it carries
+// data for, the same information a fresh forwarded-tcpip channel open would
+// otherwise have conveyed.
+type muxStreamHeader struct {
+	Laddr string
+	Lport uint32
+	Raddr string
+	Rport uint32
+}
+
+func writeMuxStreamHeader(w io.Writer, h muxStreamHeader) error {
+	b := ssh.Marshal(&internal.ChannelOpenDirectMsg{
+		Laddr: h.Laddr,
+		Lport: h.Lport,
+		Raddr: h.Raddr,
+		Rport: h.Rport,
+	})
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(b)))
+
+	if _, err := w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// muxSession lazily opens and caches, per bind address/port, the single SSH
+// channel + yamux client session that every accepted connection for that
+// forward is multiplexed over.
+type muxSession struct {
+	mu      sync.Mutex
+	session *yamux.Session
+}
+
+var (
+	muxSessionsLck sync.Mutex
+	muxSessions    = map[internal.RemoteForwardRequest]*muxSession{}
+)
+
+func getOrOpenMuxSession(rf internal.RemoteForwardRequest, sshConn ssh.Conn) (*yamux.Session, error) {
+	muxSessionsLck.Lock()
+	ms, ok := muxSessions[rf]
+	if !ok {
+		ms = &muxSession{}
+		muxSessions[rf] = ms
+	}
+	muxSessionsLck.Unlock()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.session != nil && !ms.session.IsClosed() {
+		return ms.session, nil
+	}
+
+	channel, reqs, err := sshConn.OpenChannel(muxForwardedChannelType, ssh.Marshal(&rf))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s channel: %w", muxForwardedChannelType, err)
+	}
+	go ssh.DiscardRequests(reqs)
+
+	session, err := yamux.Client(channel, yamux.DefaultConfig())
+	if err != nil {
+		channel.Close()
+		return nil, fmt.Errorf("unable to start yamux session: %w", err)
+	}
+
+	ms.session = session
+	return session, nil
+}
+
+func closeMuxSession(rf internal.RemoteForwardRequest) {
+	muxSessionsLck.Lock()
+	ms, ok := muxSessions[rf]
+	delete(muxSessions, rf)
+	muxSessionsLck.Unlock()
+
+	if !ok {
+		return
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.session != nil {
+		ms.session.Close()
+	}
+}
+
+// handleMuxData proxies a single accepted connection for rf through the
+// shared yamux session for that forward, opening a new stream per connection
+// so each gets independent flow control without paying for a fresh SSH
+// channel handshake.
+func handleMuxData(rawProxyCon net.Conn, sshConn ssh.Conn, rf internal.RemoteForwardRequest) (err error) {
+	currentMetrics().OnConnectionAccepted(rf, rawProxyCon.RemoteAddr().String())
+	started := time.Now()
+
+	proxyCon := &countingConn{Conn: rawProxyCon}
+	defer func() {
+		currentMetrics().OnConnectionClosed(rf, atomic.LoadInt64(&proxyCon.bytesIn), atomic.LoadInt64(&proxyCon.bytesOut), time.Since(started), err)
+	}()
+
+	defer proxyCon.Close()
+
+	session, err := getOrOpenMuxSession(rf, sshConn)
+	if err != nil {
+		log.Println("Opening mux session for forward failed: ", err)
+		return err
+	}
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		log.Println("Opening yamux stream for forwarded connection failed: ", err)
+		closeMuxSession(rf)
+		return err
+	}
+	defer stream.Close()
+
+	lHost, lPort := "", uint32(0)
+	if tcpAddr, ok := proxyCon.RemoteAddr().(*net.TCPAddr); ok {
+		lHost = tcpAddr.IP.String()
+		lPort = uint32(tcpAddr.Port)
+	}
+
+	if err := writeMuxStreamHeader(stream, muxStreamHeader{
+		Laddr: lHost,
+		Lport: lPort,
+		Raddr: rf.BindAddr,
+		Rport: rf.BindPort,
+	}); err != nil {
+		log.Println("Writing mux stream header failed: ", err)
+		return err
+	}
+
+	forwardsWG.Add(1)
+	go func() {
+		defer forwardsWG.Done()
+		defer stream.Close()
+		defer proxyCon.Close()
+		io.Copy(stream, proxyCon)
+	}()
+
+	_, err = io.Copy(proxyCon, stream)
+	return err
+}
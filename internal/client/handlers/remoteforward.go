@@ -7,6 +7,8 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/NHAS/reverse_ssh/internal"
 	"golang.org/x/crypto/ssh"
@@ -46,12 +48,54 @@ func StopRemoteForward(rf internal.RemoteForwardRequest) error {
 	currentRemoteForwards[rf].Listener.Close()
 	delete(currentRemoteForwards, rf)
 
-	log.Println("Stopped listening on: ", rf.BindAddr, rf.BindPort)
+	closeMuxSession(rf)
+
+	currentMetrics().OnForwardStop(rf)
 
 	return nil
 }
 
+// HandleTCPIPForwardCancel services a cancel-tcpip-forward request (RFC 4254 §7.1),
+// tearing down the listener that was previously registered by StartRemoteForward for
+// the same bind address/port.
+func HandleTCPIPForwardCancel(user *internal.User, r *ssh.Request) {
+	var rf internal.RemoteForwardRequest
+	err := ssh.Unmarshal(r.Payload, &rf)
+	if err != nil {
+		r.Reply(false, []byte(fmt.Sprintf("Unable to cancel remote forward: %s", err.Error())))
+		return
+	}
+
+	currentRemoteForwardsLck.RLock()
+	existing, ok := currentRemoteForwards[rf]
+	currentRemoteForwardsLck.RUnlock()
+
+	if !ok || (user != nil && existing.User != user) {
+		r.Reply(false, []byte("Unable to find remote forward request"))
+		return
+	}
+
+	if !remoteForwardAllowed(user, rf.BindAddr, rf.BindPort) {
+		r.Reply(false, []byte("Not permitted to cancel remote forward on this bind address/port"))
+		return
+	}
+
+	if err := StopRemoteForward(rf); err != nil {
+		r.Reply(false, []byte(err.Error()))
+		return
+	}
+
+	if user != nil {
+		user.Lock()
+		delete(user.SupportedRemoteForwards, rf)
+		user.Unlock()
+	}
+
+	r.Reply(true, nil)
+}
+
 func StartRemoteForward(user *internal.User, r *ssh.Request, sshConn ssh.Conn) {
+	registerConnection(sshConn)
 
 	var rf internal.RemoteForwardRequest
 	err := ssh.Unmarshal(r.Payload, &rf)
@@ -59,6 +103,12 @@ func StartRemoteForward(user *internal.User, r *ssh.Request, sshConn ssh.Conn) {
 		r.Reply(false, []byte(fmt.Sprintf("Unable to open remote forward: %s", err.Error())))
 		return
 	}
+
+	if !remoteForwardAllowed(user, rf.BindAddr, rf.BindPort) {
+		r.Reply(false, []byte(fmt.Sprintf("Not permitted to remote forward %s:%d", rf.BindAddr, rf.BindPort)))
+		return
+	}
+
 	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", rf.BindAddr, rf.BindPort))
 	if err != nil {
 		r.Reply(false, []byte(fmt.Sprintf("Unable to open remote forward: %s", err.Error())))
@@ -83,7 +133,7 @@ func StartRemoteForward(user *internal.User, r *ssh.Request, sshConn ssh.Conn) {
 	}
 	r.Reply(true, responseData)
 
-	log.Println("Started listening on: ", l.Addr())
+	currentMetrics().OnForwardStart(rf)
 
 	currentRemoteForwardsLck.Lock()
 
@@ -99,14 +149,31 @@ func StartRemoteForward(user *internal.User, r *ssh.Request, sshConn ssh.Conn) {
 		if err != nil {
 			return
 		}
-		go handleData(proxyCon, sshConn)
+
+		forwardsWG.Add(1)
+		go func() {
+			defer forwardsWG.Done()
+
+			if muxForwardsEnabled(sshConn) {
+				handleMuxData(proxyCon, sshConn, rf)
+				return
+			}
+
+			handleData(proxyCon, sshConn, rf)
+		}()
 	}
 
 }
 
-func handleData(proxyCon net.Conn, sshConn ssh.Conn) error {
+func handleData(rawProxyCon net.Conn, sshConn ssh.Conn, rf internal.RemoteForwardRequest) (err error) {
 
-	log.Println("Accepted new connection: ", proxyCon.RemoteAddr())
+	currentMetrics().OnConnectionAccepted(rf, rawProxyCon.RemoteAddr().String())
+	started := time.Now()
+
+	proxyCon := &countingConn{Conn: rawProxyCon}
+	defer func() {
+		currentMetrics().OnConnectionClosed(rf, atomic.LoadInt64(&proxyCon.bytesIn), atomic.LoadInt64(&proxyCon.bytesOut), time.Since(started), err)
+	}()
 
 	lHost, strPort, err := net.SplitHostPort(proxyCon.RemoteAddr().String())
 	if err != nil {
@@ -144,13 +211,25 @@ func handleData(proxyCon net.Conn, sshConn ssh.Conn) error {
 
 		return err
 	}
-	defer destination.Close()
 
 	go ssh.DiscardRequests(reqs)
 
 	log.Println("Forwarded-tcpip channel request sent and accepted")
 
+	return proxyChannel(proxyCon, destination)
+}
+
+// proxyChannel shuttles data between an accepted local connection and the SSH channel
+// opened on its behalf, regardless of whether that connection came from a TCP listener
+// or a Unix domain socket listener. The reverse-direction copy is tracked in
+// forwardsWG alongside the caller's own goroutine, so Wait doesn't return
+// until both directions have actually drained.
+func proxyChannel(proxyCon net.Conn, destination ssh.Channel) error {
+	defer destination.Close()
+
+	forwardsWG.Add(1)
 	go func() {
+		defer forwardsWG.Done()
 		defer destination.Close()
 		defer proxyCon.Close()
 		io.Copy(destination, proxyCon)
@@ -158,7 +237,7 @@ func handleData(proxyCon net.Conn, sshConn ssh.Conn) error {
 	}()
 
 	defer proxyCon.Close()
-	_, err = io.Copy(proxyCon, destination)
+	_, err := io.Copy(proxyCon, destination)
 
 	return err
 }
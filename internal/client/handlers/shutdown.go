@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"log"
+	"sync"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"golang.org/x/crypto/ssh"
+)
+
+// forwardsWG tracks in-flight handleData/handleStreamLocalData goroutines so
+// that StopAllRemoteForwards can be paired with Wait to drain outstanding
+// proxied connections before the client transport goes away.
+var forwardsWG sync.WaitGroup
+
+var (
+	activeConnLck sync.RWMutex
+	activeConn    ssh.Conn
+)
+
+// registerConnection records sshConn as the active SSH transport, so
+// CloseActiveConnection can close it during a graceful shutdown.
+func registerConnection(sshConn ssh.Conn) {
+	activeConnLck.Lock()
+	defer activeConnLck.Unlock()
+
+	if activeConn == sshConn {
+		return
+	}
+
+	if activeConn != nil {
+		resetMuxState(activeConn)
+	}
+
+	activeConn = sshConn
+}
+
+// CloseActiveConnection closes the SSH transport most recently registered by
+// a Start*Forward call.
+func CloseActiveConnection() {
+	activeConnLck.RLock()
+	defer activeConnLck.RUnlock()
+
+	if activeConn != nil {
+		activeConn.Close()
+	}
+}
+
+// Wait blocks until every in-flight forwarded connection has finished
+// copying data and closed. Callers that need a bound on how long they wait
+// should run this in a goroutine and select on a timeout.
+func Wait() {
+	forwardsWG.Wait()
+}
+
+// StopAllRemoteForwards closes every listener currently registered for this
+// client - TCP, Unix domain socket, and SOCKS/HTTP-CONNECT dynamic forwards
+// alike - unblocking their Accept loops so the client can shut down cleanly.
+func StopAllRemoteForwards() {
+	currentRemoteForwardsLck.RLock()
+	tcpForwards := make([]internal.RemoteForwardRequest, 0, len(currentRemoteForwards))
+	for rf := range currentRemoteForwards {
+		tcpForwards = append(tcpForwards, rf)
+	}
+	currentRemoteForwardsLck.RUnlock()
+
+	for _, rf := range tcpForwards {
+		if err := StopRemoteForward(rf); err != nil {
+			log.Println("Stopping remote forward during shutdown failed: ", err)
+		}
+	}
+
+	currentRemoteStreamLocalForwardsLck.RLock()
+	socketForwards := make([]string, 0, len(currentRemoteStreamLocalForwards))
+	for socketPath := range currentRemoteStreamLocalForwards {
+		socketForwards = append(socketForwards, socketPath)
+	}
+	currentRemoteStreamLocalForwardsLck.RUnlock()
+
+	for _, socketPath := range socketForwards {
+		if err := StopRemoteStreamLocalForward(socketPath); err != nil {
+			log.Println("Stopping remote streamlocal forward during shutdown failed: ", err)
+		}
+	}
+
+	currentDynamicForwardsLck.RLock()
+	dynamicForwards := make([]internal.RemoteForwardRequest, 0, len(currentDynamicForwards))
+	for rf := range currentDynamicForwards {
+		dynamicForwards = append(dynamicForwards, rf)
+	}
+	currentDynamicForwardsLck.RUnlock()
+
+	for _, rf := range dynamicForwards {
+		if err := StopDynamicForward(rf); err != nil {
+			log.Println("Stopping dynamic forward during shutdown failed: ", err)
+		}
+	}
+}
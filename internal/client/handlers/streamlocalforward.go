@@ -0,0 +1,286 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NHAS/reverse_ssh/internal"
+	"golang.org/x/crypto/ssh"
+)
+
+// streamLocalForwardRequest mirrors the payload of OpenSSH's
+// streamlocal-forward@openssh.com / cancel-streamlocal-forward@openssh.com
+// global requests: a single string naming the Unix domain socket path to
+// listen on (or stop listening on).
+type streamLocalForwardRequest struct {
+	SocketPath string
+}
+
+// forwardedStreamLocalMsg is the payload of a forwarded-streamlocal@openssh.com
+// channel open, as sent by the client for each accepted connection.
+type forwardedStreamLocalMsg struct {
+	SocketPath string
+	Reserved   string
+}
+
+type remoteStreamLocalForward struct {
+	Listener net.Listener
+	User     *internal.User
+}
+
+// streamLocalForwardMetricsKey adapts a socket path to the
+// internal.RemoteForwardRequest Metrics is keyed on, so streamlocal forwards
+// are reported the same way TCP forwards are.
+func streamLocalForwardMetricsKey(socketPath string) internal.RemoteForwardRequest {
+	return internal.RemoteForwardRequest{BindAddr: socketPath}
+}
+
+var (
+	currentRemoteStreamLocalForwardsLck sync.RWMutex
+	currentRemoteStreamLocalForwards    = map[string]remoteStreamLocalForward{}
+)
+
+// SocketPathRule is a single allowed socket path parsed from a
+// permit-remote-streamlocal-forward option entry. A trailing "*" matches any
+// path sharing that prefix, otherwise the path must match exactly.
+type SocketPathRule string
+
+func (s SocketPathRule) allows(path string) bool {
+	if strings.HasSuffix(string(s), "*") {
+		return strings.HasPrefix(path, strings.TrimSuffix(string(s), "*"))
+	}
+
+	return string(s) == path
+}
+
+var (
+	defaultAllowedRemoteSocketPathsLck sync.RWMutex
+	defaultAllowedRemoteSocketPaths    []SocketPathRule
+)
+
+// SetDefaultAllowedRemoteSocketPaths configures the default ACL that
+// remoteStreamLocalForwardAllowed checks every streamlocal forward request
+// against, both server-initiated (user == nil) and per-user ones, mirroring
+// SetDefaultAllowedRemoteBinds for TCP forwards. No per-user rule set is
+// consulted.
+func SetDefaultAllowedRemoteSocketPaths(rules []SocketPathRule) {
+	defaultAllowedRemoteSocketPathsLck.Lock()
+	defer defaultAllowedRemoteSocketPathsLck.Unlock()
+
+	defaultAllowedRemoteSocketPaths = rules
+}
+
+func getDefaultAllowedRemoteSocketPaths() []SocketPathRule {
+	defaultAllowedRemoteSocketPathsLck.RLock()
+	defer defaultAllowedRemoteSocketPathsLck.RUnlock()
+
+	return defaultAllowedRemoteSocketPaths
+}
+
+// ParsePermitRemoteStreamLocalForward parses the value of an authorized_keys
+// permit-remote-streamlocal-forward="..." option, a comma separated list of
+// exact paths or "prefix*" globs.
+func ParsePermitRemoteStreamLocalForward(value string) ([]SocketPathRule, error) {
+	var rules []SocketPathRule
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		rules = append(rules, SocketPathRule(entry))
+	}
+
+	return rules, nil
+}
+
+// remoteStreamLocalForwardAllowed checks socketPath against the client-wide
+// default ACL set by SetDefaultAllowedRemoteSocketPaths, mirroring
+// remoteForwardAllowed for TCP binds. An empty rule set is treated as "no
+// restriction". See remoteForwardAllowed's doc comment for why this doesn't
+// yet scope rules per user.
+func remoteStreamLocalForwardAllowed(user *internal.User, socketPath string) bool {
+	rules := getDefaultAllowedRemoteSocketPaths()
+
+	if len(rules) == 0 {
+		return true
+	}
+
+	for _, rule := range rules {
+		if rule.allows(socketPath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// safeRemoveStaleSocket unlinks path only if it's itself a Unix socket (i.e.
+// a stale listener left behind by a previous forward). SocketPath comes
+// straight off the wire, so anything else at that path is left untouched
+// rather than deleted.
+func safeRemoveStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("refusing to listen on %s: existing file is not a socket", path)
+	}
+
+	return os.Remove(path)
+}
+
+func StopRemoteStreamLocalForward(socketPath string) error {
+	currentRemoteStreamLocalForwardsLck.Lock()
+	defer currentRemoteStreamLocalForwardsLck.Unlock()
+
+	if _, ok := currentRemoteStreamLocalForwards[socketPath]; !ok {
+		return fmt.Errorf("Unable to find remote streamlocal forward request")
+	}
+
+	currentRemoteStreamLocalForwards[socketPath].Listener.Close()
+	delete(currentRemoteStreamLocalForwards, socketPath)
+
+	currentMetrics().OnForwardStop(streamLocalForwardMetricsKey(socketPath))
+
+	log.Println("Stopped listening on unix socket: ", socketPath)
+
+	return nil
+}
+
+// HandleStreamLocalForwardCancel services a cancel-streamlocal-forward@openssh.com
+// request, tearing down the Unix socket listener previously registered by
+// StartRemoteStreamLocalForward.
+func HandleStreamLocalForwardCancel(user *internal.User, r *ssh.Request) {
+	var rf streamLocalForwardRequest
+	err := ssh.Unmarshal(r.Payload, &rf)
+	if err != nil {
+		r.Reply(false, []byte(fmt.Sprintf("Unable to cancel remote streamlocal forward: %s", err.Error())))
+		return
+	}
+
+	currentRemoteStreamLocalForwardsLck.RLock()
+	existing, ok := currentRemoteStreamLocalForwards[rf.SocketPath]
+	currentRemoteStreamLocalForwardsLck.RUnlock()
+
+	if !ok || (user != nil && existing.User != user) {
+		r.Reply(false, []byte("Unable to find remote streamlocal forward request"))
+		return
+	}
+
+	if !remoteStreamLocalForwardAllowed(user, rf.SocketPath) {
+		r.Reply(false, []byte("Not permitted to cancel remote streamlocal forward on this path"))
+		return
+	}
+
+	if err := StopRemoteStreamLocalForward(rf.SocketPath); err != nil {
+		r.Reply(false, []byte(err.Error()))
+		return
+	}
+
+	r.Reply(true, nil)
+}
+
+// StartRemoteStreamLocalForward services a streamlocal-forward@openssh.com request,
+// listening on the requested Unix domain socket path and relaying each accepted
+// connection to the controller over a forwarded-streamlocal@openssh.com channel.
+func StartRemoteStreamLocalForward(user *internal.User, r *ssh.Request, sshConn ssh.Conn) {
+	registerConnection(sshConn)
+
+	var rf streamLocalForwardRequest
+	err := ssh.Unmarshal(r.Payload, &rf)
+	if err != nil {
+		r.Reply(false, []byte(fmt.Sprintf("Unable to open remote streamlocal forward: %s", err.Error())))
+		return
+	}
+
+	if !remoteStreamLocalForwardAllowed(user, rf.SocketPath) {
+		r.Reply(false, []byte(fmt.Sprintf("Not permitted to streamlocal forward %s", rf.SocketPath)))
+		return
+	}
+
+	if err := safeRemoveStaleSocket(rf.SocketPath); err != nil {
+		r.Reply(false, []byte(fmt.Sprintf("Unable to open remote streamlocal forward: %s", err.Error())))
+		return
+	}
+
+	l, err := net.Listen("unix", rf.SocketPath)
+	if err != nil {
+		r.Reply(false, []byte(fmt.Sprintf("Unable to open remote streamlocal forward: %s", err.Error())))
+		return
+	}
+	defer l.Close()
+
+	defer StopRemoteStreamLocalForward(rf.SocketPath)
+
+	r.Reply(true, nil)
+
+	currentMetrics().OnForwardStart(streamLocalForwardMetricsKey(rf.SocketPath))
+
+	log.Println("Started listening on unix socket: ", rf.SocketPath)
+
+	currentRemoteStreamLocalForwardsLck.Lock()
+	currentRemoteStreamLocalForwards[rf.SocketPath] = remoteStreamLocalForward{
+		Listener: l,
+		User:     user,
+	}
+	currentRemoteStreamLocalForwardsLck.Unlock()
+
+	for {
+		proxyCon, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		forwardsWG.Add(1)
+		go func() {
+			defer forwardsWG.Done()
+			handleStreamLocalData(proxyCon, sshConn, rf.SocketPath)
+		}()
+	}
+}
+
+func handleStreamLocalData(rawProxyCon net.Conn, sshConn ssh.Conn, socketPath string) (err error) {
+	rf := streamLocalForwardMetricsKey(socketPath)
+
+	currentMetrics().OnConnectionAccepted(rf, rawProxyCon.RemoteAddr().String())
+	started := time.Now()
+
+	proxyCon := &countingConn{Conn: rawProxyCon}
+	defer func() {
+		currentMetrics().OnConnectionClosed(rf, atomic.LoadInt64(&proxyCon.bytesIn), atomic.LoadInt64(&proxyCon.bytesOut), time.Since(started), err)
+	}()
+
+	log.Println("Accepted new streamlocal connection for: ", socketPath)
+
+	drtMsg := forwardedStreamLocalMsg{
+		SocketPath: socketPath,
+	}
+
+	b := ssh.Marshal(&drtMsg)
+
+	destination, reqs, err := sshConn.OpenChannel("forwarded-streamlocal@openssh.com", b)
+	if err != nil {
+		log.Println("Opening forwarded-streamlocal@openssh.com channel to server failed: ", err)
+
+		return err
+	}
+
+	go ssh.DiscardRequests(reqs)
+
+	log.Println("Forwarded-streamlocal channel request sent and accepted")
+
+	return proxyChannel(proxyCon, destination)
+}